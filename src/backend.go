@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ---------- Mirror backends ----------
+//
+// A mirror target is a MirrorBackend plus a backendRunner that owns
+// its own queue and worker pool, so a slow or down target can't starve
+// the others. Targets are configured either with a repeatable
+// -backend flag for simple setups, or a JSON -backends-config file for
+// per-target transport tuning; the original single -host flag still
+// works and becomes one backend named "default".
+
+// MirrorBackend sends a single mirror job to one destination. statusCode
+// is the upstream HTTP status on success and 0 when err is set (e.g. a
+// transport-level failure that never got a response).
+type MirrorBackend interface {
+	Name() string
+	Send(ctx context.Context, job mirrorJob) (statusCode int, err error)
+}
+
+// backendConfig is both the JSON config file schema and the result of
+// parsing a -backend flag value.
+type backendConfig struct {
+	Name       string  `json:"name"`
+	URL        string  `json:"url"`
+	Weight     float64 `json:"weight"`
+	SampleRate float64 `json:"sample_rate"`
+
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queue_size"`
+
+	MaxIdleConns          int    `json:"max_idle_conns"`
+	MaxIdleConnsPerHost   int    `json:"max_idle_conns_per_host"`
+	IdleConnTimeout       string `json:"idle_conn_timeout"`
+	TLSHandshakeTimeout   string `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string `json:"response_header_timeout"`
+	Timeout               string `json:"timeout"`
+	InsecureSkipVerify    bool   `json:"insecure_skip_verify"`
+	DisableHTTP2          bool   `json:"disable_http2"`
+}
+
+// backendRunner pairs a MirrorBackend with its own job queue and
+// worker pool, plus the fan-out policy (weight, sample rate) enqueue
+// uses to decide whether a job goes to it at all.
+type backendRunner struct {
+	backend    MirrorBackend
+	weight     float64
+	sampleRate float64
+
+	queue      chan mirrorJob
+	queueSize  int
+	queueBlock bool
+	workers    int
+	wg         sync.WaitGroup
+
+	// busyWorkers counts workers currently inside backend.Send, for the
+	// spoa_mirror_worker_busy metric.
+	busyWorkers int64
+
+	// breaker isolates this target's failures from the others; retry
+	// is the shared policy workers consult before requeueing a job,
+	// including via a time.AfterFunc timer that can still fire after
+	// close() has run.
+	breaker *circuitBreaker
+	retry   retryPolicy
+
+	// closeMu, closed and inFlight keep close() from ever closing
+	// r.queue while an enqueue call might still send on it: once
+	// closed is true no new enqueue is let past the check (a retry
+	// timer that fires after shutdown just drops its job instead),
+	// and close() waits out inFlight so any enqueue that was already
+	// past the check finishes its send first.
+	closeMu  sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
+
+var backendRunners []*backendRunner
+
+// backendFlagList collects repeated -backend flag values.
+type backendFlagList []string
+
+func (b *backendFlagList) String() string { return strings.Join(*b, ",") }
+func (b *backendFlagList) Set(v string) error {
+	*b = append(*b, v)
+	return nil
+}
+
+// parseBackendSpec parses a -backend flag value of the form
+// "name=url;weight=0.5;sample=0.1" (weight/sample default to 1).
+func parseBackendSpec(spec string) (backendConfig, error) {
+	cfg := backendConfig{Weight: 1, SampleRate: 1}
+	parts := strings.Split(spec, ";")
+	nameURL := strings.SplitN(parts[0], "=", 2)
+	if len(nameURL) != 2 || nameURL[0] == "" || nameURL[1] == "" {
+		return cfg, fmt.Errorf("invalid -backend spec %q, want name=url[;weight=W][;sample=S]", spec)
+	}
+	cfg.Name = nameURL[0]
+	cfg.URL = nameURL[1]
+
+	for _, opt := range parts[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("invalid -backend option %q in spec %q", opt, spec)
+		}
+		val, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid -backend option %q in spec %q: %w", opt, spec, err)
+		}
+		switch kv[0] {
+		case "weight":
+			cfg.Weight = val
+		case "sample":
+			cfg.SampleRate = val
+		default:
+			return cfg, fmt.Errorf("unknown -backend option %q in spec %q", kv[0], spec)
+		}
+	}
+	return cfg, nil
+}
+
+func loadBackendsConfig(path string) ([]backendConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read backends config %s: %w", path, err)
+	}
+	var cfgs []backendConfig
+	if err := json.Unmarshal(data, &cfgs); err != nil {
+		return nil, fmt.Errorf("parse backends config %s: %w", path, err)
+	}
+	return cfgs, nil
+}
+
+// newBackendRunner builds a backendRunner from cfg, filling in global
+// defaults (workers, queue-size, queue-block) for anything cfg leaves
+// unset.
+func newBackendRunner(cfg backendConfig) (*backendRunner, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("backend config is missing a name")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("backend %q is missing a url", cfg.Name)
+	}
+	if strings.HasSuffix(cfg.URL, "/") {
+		return nil, fmt.Errorf("backend %q url must not end with a trailing slash", cfg.Name)
+	}
+
+	weight := cfg.Weight
+	if weight == 0 {
+		weight = 1
+	}
+	sampleRate := cfg.SampleRate
+	if sampleRate == 0 {
+		sampleRate = 1
+	}
+
+	transport, err := buildTransport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: %w", cfg.Name, err)
+	}
+	timeout, err := durationOrDefault(cfg.Timeout, 1*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("backend %q: timeout: %w", cfg.Name, err)
+	}
+
+	backend := &httpBackend{
+		name:    cfg.Name,
+		baseURL: cfg.URL,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}
+
+	runnerWorkers := cfg.Workers
+	if runnerWorkers == 0 {
+		runnerWorkers = workers
+	}
+	runnerQueueSize := cfg.QueueSize
+	if runnerQueueSize == 0 {
+		runnerQueueSize = queueSize
+	}
+
+	return &backendRunner{
+		backend:    backend,
+		weight:     weight,
+		sampleRate: sampleRate,
+		queue:      make(chan mirrorJob, runnerQueueSize),
+		queueSize:  runnerQueueSize,
+		queueBlock: queueBlock,
+		workers:    runnerWorkers,
+		breaker:    newCircuitBreaker(breakerWindowSize, breakerThreshold, breakerCooldown, breakerHalfOpenProbes),
+		retry:      activeRetryPolicy,
+	}, nil
+}
+
+func buildTransport(cfg backendConfig) (*http.Transport, error) {
+	maxIdleConns := cfg.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = 10000
+	}
+	maxIdleConnsPerHost := cfg.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost == 0 {
+		maxIdleConnsPerHost = 10000
+	}
+	idleConnTimeout, err := durationOrDefault(cfg.IdleConnTimeout, 90*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("idle_conn_timeout: %w", err)
+	}
+	tlsHandshakeTimeout, err := durationOrDefault(cfg.TLSHandshakeTimeout, 1*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("tls_handshake_timeout: %w", err)
+	}
+	responseHeaderTimeout, err := durationOrDefault(cfg.ResponseHeaderTimeout, 1*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("response_header_timeout: %w", err)
+	}
+
+	t := &http.Transport{
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+		ForceAttemptHTTP2:     !cfg.DisableHTTP2,
+	}
+	if cfg.InsecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return t, nil
+}
+
+func durationOrDefault(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// run starts the runner's worker pool; each worker sends jobs to the
+// backend and hands every job that reaches a terminal outcome to
+// finalizeJob, which acks it in the WAL once every backend it was
+// fanned out to is done with it.
+func (r *backendRunner) run() {
+	r.wg.Add(r.workers)
+	for i := 0; i < r.workers; i++ {
+		go func(id int) {
+			defer r.wg.Done()
+			if debug {
+				log.Printf("[%s worker %d] started", r.backend.Name(), id)
+			}
+			for job := range r.queue {
+				if !r.breaker.allow() {
+					jobsDroppedTotal.inc(joinLabels(labelPair("reason", "breaker_open"), labelPair("backend", r.backend.Name())))
+					finalizeJob(job)
+					continue
+				}
+
+				atomic.AddInt64(&r.busyWorkers, 1)
+				start := time.Now()
+				code, err := r.backend.Send(requestContext(), job)
+				atomic.AddInt64(&r.busyWorkers, -1)
+				httpDuration.observe(labelPair("backend", r.backend.Name()), time.Since(start).Seconds())
+
+				failed := err != nil || code >= 500 || code == 429
+				r.breaker.record(!failed)
+
+				if err != nil {
+					log.Printf("[%s] mirror failed for %s %s: %v", r.backend.Name(), job.method, job.path, err)
+					httpRequestsTotal.inc(joinLabels(labelPair("method", job.method), labelPair("code", "0"), labelPair("backend", r.backend.Name())))
+				} else {
+					httpRequestsTotal.inc(joinLabels(labelPair("method", job.method), labelPair("code", strconv.Itoa(code)), labelPair("backend", r.backend.Name())))
+				}
+
+				if failed && r.retry.shouldRetry(code, err, job.attempt) {
+					r.scheduleRetry(job)
+					continue
+				}
+
+				finalizeJob(job)
+			}
+			if debug {
+				log.Printf("[%s worker %d] stopped", r.backend.Name(), id)
+			}
+		}(i + 1)
+	}
+}
+
+// enqueue puts job on r.queue, unless r is already shutting down - in
+// which case r.queue may already be closed, so sending on it would
+// panic, and the job is dropped instead. This is what lets a retry
+// timer (backend.go's scheduleRetry) fire after close() has run: it
+// just finds closed set and drops the job rather than reaching the
+// channel send below at all.
+func (r *backendRunner) enqueue(job mirrorJob) {
+	r.closeMu.Lock()
+	if r.closed {
+		r.closeMu.Unlock()
+		jobsDroppedTotal.inc(joinLabels(labelPair("reason", "shutting_down"), labelPair("backend", r.backend.Name())))
+		finalizeJob(job)
+		return
+	}
+	r.inFlight.Add(1)
+	r.closeMu.Unlock()
+	defer r.inFlight.Done()
+
+	if r.queueBlock {
+		r.queue <- job
+		return
+	}
+	select {
+	case r.queue <- job:
+	default:
+		jobsDroppedTotal.inc(joinLabels(labelPair("reason", "queue_full"), labelPair("backend", r.backend.Name())))
+		if debug {
+			log.Printf("[%s] queue full (size=%d): dropping mirror job %s %s", r.backend.Name(), r.queueSize, job.method, job.path)
+		}
+		finalizeJob(job)
+	}
+}
+
+// finalizeJob marks job done with this backend: it acks job's WAL
+// entry once every backend it was fanned out to has reported a
+// terminal outcome, and removes its spilled body file once every
+// backend (and retry) is done reading it. A terminal outcome is a
+// successful send, retries exhausted, or the job being dropped
+// outright (queue full, breaker open, shutting down). Every place a
+// job stops being this backend's responsibility must call this, or
+// dropped jobs leak as permanently "pending" WAL entries that get
+// replayed forever and block their segment from ever compacting.
+func finalizeJob(job mirrorJob) {
+	if job.ack != nil && job.ack.done() && theWAL != nil {
+		theWAL.ack(job.seq)
+	}
+	finalizeBody(job)
+}
+
+// scheduleRetry requeues job after a jittered backoff delay without
+// blocking the worker that hit the failure: the time.AfterFunc timer
+// is the "separate delay queue" that keeps a failing target's retries
+// off the hot path of healthy ones.
+func (r *backendRunner) scheduleRetry(job mirrorJob) {
+	job.attempt++
+	delay := r.retry.backoff(job.attempt - 1)
+	retriesTotal.inc(labelPair("backend", r.backend.Name()))
+	time.AfterFunc(delay, func() {
+		r.enqueue(job)
+	})
+}
+
+// close stops new jobs from reaching r.queue - including any retry
+// timer that fires from here on, which will now just drop its job -
+// waits for sends already in flight to land, and only then closes the
+// channel so its workers' range loops can exit.
+func (r *backendRunner) close() {
+	r.closeMu.Lock()
+	r.closed = true
+	r.closeMu.Unlock()
+
+	r.inFlight.Wait()
+	close(r.queue)
+}
+
+// ackTracker counts down as each backend a job was fanned out to
+// finishes, so the WAL entry is only acked once nobody needs it
+// replayed anymore.
+type ackTracker struct {
+	remaining int32
+}
+
+func (a *ackTracker) done() bool {
+	return atomic.AddInt32(&a.remaining, -1) == 0
+}
+
+// selectBackends applies each runner's sampling policy for one job,
+// independently of the others.
+func selectBackends() []*backendRunner {
+	var selected []*backendRunner
+	for _, r := range backendRunners {
+		rate := r.effectiveSampleRate()
+		if rate >= 1 || rand.Float64() < rate {
+			selected = append(selected, r)
+		}
+	}
+	return selected
+}
+
+// effectiveSampleRate is the probability that a job fans out to r: its
+// explicit -backend sample rate scaled by its weight, so weight gives
+// an operator a way to shift a backend's share of mirrored traffic
+// (e.g. ramping a canary from 1% to 50%) independently of a separate
+// sample rate some other backend may be using to cap its own volume.
+func (r *backendRunner) effectiveSampleRate() float64 {
+	rate := r.sampleRate * r.weight
+	if rate > 1 {
+		rate = 1
+	}
+	if rate < 0 {
+		rate = 0
+	}
+	return rate
+}
+
+// fanOut dispatches job to every backend selected by sampling. job
+// must already carry its WAL seq (if any) before this is called.
+func fanOut(job mirrorJob) {
+	selected := selectBackends()
+	if len(selected) == 0 {
+		if theWAL != nil && job.seq != 0 {
+			theWAL.ack(job.seq)
+		}
+		if job.bodyFile != "" {
+			if err := os.Remove(job.bodyFile); err != nil && debug {
+				log.Printf("remove spilled body %s: %v", job.bodyFile, err)
+			}
+		}
+		return
+	}
+	job.ack = &ackTracker{remaining: int32(len(selected))}
+	if job.bodyFile != "" {
+		job.bodyRef = &bodyRefCounter{remaining: int32(len(selected))}
+	}
+	for _, r := range selected {
+		r.enqueue(job)
+	}
+}
+
+// dispatch persists job to the WAL (if enabled) and fans it out to
+// every sampled backend.
+func dispatch(job mirrorJob) {
+	atomic.AddUint64(&jobsEnqueuedTotal, 1)
+	if theWAL != nil {
+		var err error
+		job, err = theWAL.append(job)
+		if err != nil {
+			log.Printf("wal: failed to persist mirror job %s %s: %v", job.method, job.path, err)
+			return
+		}
+	}
+	fanOut(job)
+}
+
+// registerBackendFlags wires the -host, -backend and -backends-config
+// flags and, once parsed, resolves them all into a single list of
+// backendConfig.
+func registerBackendFlags() (legacyHost *string, backendSpecs *backendFlagList, backendsConfigPath *string) {
+	legacyHost = flag.String("host", "", "Hostname where requests should be mirrored to (no trailing slash); shorthand for a single backend named \"default\"")
+	backendSpecs = &backendFlagList{}
+	flag.Var(backendSpecs, "backend", "Additional mirror backend as name=url[;weight=W][;sample=S]; may be repeated")
+	backendsConfigPath = flag.String("backends-config", "", "Path to a JSON file listing mirror backend configs")
+	return
+}
+
+func resolveBackendConfigs(legacyHost string, backendSpecs backendFlagList, backendsConfigPath string) ([]backendConfig, error) {
+	var cfgs []backendConfig
+
+	if backendsConfigPath != "" {
+		fileCfgs, err := loadBackendsConfig(backendsConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, fileCfgs...)
+	}
+	for _, spec := range backendSpecs {
+		cfg, err := parseBackendSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	if legacyHost != "" {
+		cfgs = append(cfgs, backendConfig{Name: "default", URL: legacyHost, Weight: 1, SampleRate: 1})
+	}
+	return cfgs, nil
+}
+
+// ---------- HTTP backend ----------
+
+type httpBackend struct {
+	name    string
+	baseURL string
+	client  *http.Client
+}
+
+func (b *httpBackend) Name() string { return b.name }
+
+func (b *httpBackend) Send(ctx context.Context, job mirrorJob) (int, error) {
+	bodyReader, contentLength, cleanupBody, err := openBody(job)
+	if err != nil {
+		return 0, fmt.Errorf("open body: %w", err)
+	}
+	defer cleanupBody()
+
+	req, err := http.NewRequestWithContext(ctx, job.method, b.baseURL+job.path, bodyReader)
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+	req.ContentLength = contentLength
+	if contentLength < 0 {
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(job.headers))
+	for sc.Scan() {
+		header := sc.Text()
+		if header == "" {
+			continue
+		}
+		parts := strings.SplitN(header, ": ", 2)
+		if len(parts) != 2 {
+			if debug {
+				log.Printf("[%s] invalid header format: %q", b.name, header)
+			}
+			continue
+		}
+		req.Header.Set(parts[0], parts[1])
+	}
+	if err := sc.Err(); err != nil && debug {
+		log.Printf("[%s] scanner error on headers: %v", b.name, err)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("do request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if verbose {
+		log.Printf("SPOA-MIRROR HTTP %s %s %s -> %d", b.name, job.method, req.URL, resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
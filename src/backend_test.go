@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+// TestEffectiveSampleRateAppliesWeight guards against weight being a
+// parsed-but-ignored knob: it must scale a backend's chance of being
+// selected, independently of its sample rate.
+func TestEffectiveSampleRateAppliesWeight(t *testing.T) {
+	cases := []struct {
+		name       string
+		sampleRate float64
+		weight     float64
+		want       float64
+	}{
+		{"defaults fan out every time", 1, 1, 1},
+		{"weight alone throttles traffic", 1, 0.1, 0.1},
+		{"sample and weight combine", 0.5, 0.5, 0.25},
+		{"weight cannot push rate above 1", 1, 2, 1},
+		{"zero weight disables the backend", 1, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := &backendRunner{sampleRate: c.sampleRate, weight: c.weight}
+			if got := r.effectiveSampleRate(); got != c.want {
+				t.Fatalf("effectiveSampleRate(sample=%g, weight=%g) = %g, want %g", c.sampleRate, c.weight, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// ---------- Large body handling ----------
+//
+// handler() receives the full request body from the SPOE engine as a
+// []byte, but holding on to that slice for as long as the job sits in
+// a backend's queue pins memory per in-flight mirror proportional to
+// body size. Bodies over -body-spill-threshold are written to a temp
+// file instead and streamed back off disk when the job is finally
+// sent, so queue depth no longer multiplies with payload size.
+// -max-body-bytes bounds the worst case by dropping oversize jobs
+// outright.
+//
+// A spilled body's file is shared by every backend the job fans out
+// to, and by every retry against each of them, so it can only be
+// removed once nobody has a reason to read it again: bodyRefCounter
+// (set up alongside the job's ackTracker in fanOut) counts that down,
+// and finalizeBody removes the file when it hits zero. openBody's own
+// cleanup func only closes this attempt's file handle.
+
+// bodySpillDir is where spilled bodies are written. It defaults to
+// os.TempDir(), but main() points it at a subdirectory of -wal-path
+// when the WAL is enabled: a spilled body's path is the only thing the
+// WAL durably records for that job (wal.go's append), so the file
+// itself needs to survive whatever os.TempDir() doesn't (e.g. a tmpfs
+// wiped on container restart) for replayPending to be able to resend
+// it after a crash.
+var bodySpillDir string
+
+// bodyRefCounter tracks how many backends - across every retry each
+// one makes - still need to read a job's spilled body file.
+type bodyRefCounter struct {
+	remaining int32
+}
+
+func (b *bodyRefCounter) done() bool {
+	return atomic.AddInt32(&b.remaining, -1) == 0
+}
+
+// prepareBody decides how job should hold reqBody: inline, spilled to
+// disk, or dropped. It reports false when the job must be dropped
+// because reqBody exceeds -max-body-bytes.
+func prepareBody(job *mirrorJob, reqBody []byte) bool {
+	size := int64(len(reqBody))
+	job.bodySize = size
+
+	if maxBodyBytes > 0 && size > maxBodyBytes {
+		jobsDroppedTotal.inc(labelPair("reason", "max_body_bytes"))
+		log.Printf("dropping mirror job %s %s: body of %d bytes exceeds -max-body-bytes=%d", job.method, job.path, size, maxBodyBytes)
+		return false
+	}
+
+	if bodySpillThreshold > 0 && size > bodySpillThreshold {
+		if path, err := spillToDisk(reqBody); err != nil {
+			log.Printf("spilling body to disk failed, keeping %d bytes in memory: %v", size, err)
+		} else {
+			job.bodyFile = path
+			atomic.AddUint64(&bodiesSpilledTotal, 1)
+			return true
+		}
+	}
+
+	job.body = append([]byte(nil), reqBody...)
+	return true
+}
+
+func spillToDisk(body []byte) (string, error) {
+	f, err := os.CreateTemp(bodySpillDir, "spoa-mirror-body-*")
+	if err != nil {
+		return "", fmt.Errorf("create temp file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(body); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("write temp file %s: %w", f.Name(), err)
+	}
+	return f.Name(), nil
+}
+
+// openBody returns a reader for job's body, the Content-Length to
+// advertise to the target (-1 requests chunked transfer encoding for
+// bodies of unknown size), and a cleanup func that must be called once
+// the request has been sent. That cleanup only closes this attempt's
+// file handle - see finalizeBody for when the underlying file itself
+// is removed.
+func openBody(job mirrorJob) (io.Reader, int64, func(), error) {
+	if job.bodyFile == "" {
+		return bytes.NewReader(job.body), job.bodySize, func() {}, nil
+	}
+
+	f, err := os.Open(job.bodyFile)
+	if err != nil {
+		return nil, 0, func() {}, fmt.Errorf("open spilled body %s: %w", job.bodyFile, err)
+	}
+	// Disk-spilled bodies are always sent chunked: it avoids a Stat
+	// round-trip and keeps this path identical to a true streaming
+	// source (e.g. a ring buffer still being filled) whose size
+	// isn't known up front.
+	return f, -1, func() { f.Close() }, nil
+}
+
+// finalizeBody removes job's spilled body file once every backend it
+// was fanned out to, across every retry, is done reading it. It is a
+// no-op for jobs whose body was never spilled.
+func finalizeBody(job mirrorJob) {
+	if job.bodyFile == "" || job.bodyRef == nil {
+		return
+	}
+	if job.bodyRef.done() {
+		if err := os.Remove(job.bodyFile); err != nil && debug {
+			log.Printf("remove spilled body %s: %v", job.bodyFile, err)
+		}
+	}
+}
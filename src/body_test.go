@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFinalizeBodySurvivesMultipleUsers guards against a spilled body
+// file being deleted while another fan-out target (or a pending retry
+// against the same target) still needs to read it: the file must only
+// be removed once every user has finalized.
+func TestFinalizeBodySurvivesMultipleUsers(t *testing.T) {
+	f, err := os.CreateTemp("", "spoa-mirror-body-test-*")
+	if err != nil {
+		t.Fatalf("create temp file: %v", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	job := mirrorJob{bodyFile: path, bodyRef: &bodyRefCounter{remaining: 2}}
+
+	// First backend (or retry attempt) finishes with the file: a
+	// second user is still pending, so it must still be readable.
+	finalizeBody(job)
+	if _, err := os.Open(path); err != nil {
+		t.Fatalf("spilled body removed while a second user still pending: %v", err)
+	}
+
+	// Second, final user finishes: only now may the file go away.
+	finalizeBody(job)
+	if _, err := os.Open(path); !os.IsNotExist(err) {
+		t.Fatalf("spilled body still present after every user finalized: err=%v", err)
+	}
+}
+
+// TestSpillToDiskUsesBodySpillDir guards against a spilled body
+// landing in os.TempDir() when the WAL is enabled: main() points
+// bodySpillDir at a subdirectory of -wal-path so the file shares the
+// WAL's durability, and spillToDisk must honor that.
+func TestSpillToDiskUsesBodySpillDir(t *testing.T) {
+	dir := t.TempDir()
+	old := bodySpillDir
+	bodySpillDir = dir
+	defer func() { bodySpillDir = old }()
+
+	path, err := spillToDisk([]byte("hello"))
+	if err != nil {
+		t.Fatalf("spillToDisk: %v", err)
+	}
+	defer os.Remove(path)
+
+	if got := filepath.Dir(path); got != dir {
+		t.Fatalf("spilled body written to %s, want under %s", got, dir)
+	}
+}
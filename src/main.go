@@ -1,17 +1,14 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"net"
-	"net/http"
 	"os"
+	"path/filepath"
 	"runtime"
-	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/negasus/haproxy-spoe-go/agent"
@@ -22,34 +19,37 @@ import (
 /*
    ./spoa-mirror -listen 0.0.0.0:20009 -host https://test-system.example.com \
                  -workers 64 -queue-size 50000 -queue-block=false -debug
-*/
-
-var httpTransport = &http.Transport{
-	MaxIdleConns:          10000,
-	MaxIdleConnsPerHost:   10000,
-	MaxConnsPerHost:       0,
-	IdleConnTimeout:       90 * time.Second,
-	TLSHandshakeTimeout:   1 * time.Second,
-	ResponseHeaderTimeout: 1 * time.Second,
-	ForceAttemptHTTP2:     true,
-}
 
-var httpClient = &http.Client{
-	Transport: httpTransport,
-	Timeout:   1 * time.Second,
-}
+   ./spoa-mirror -listen 0.0.0.0:20009 \
+                 -backend 'staging=https://staging.example.com;weight=1;sample=1' \
+                 -backend 'canary=https://canary.example.com;weight=0.1;sample=0.1'
+*/
 
 var (
 	listenAddr string
-	mirrorhost string
 	debug      bool
 	verbose    bool
 
 	workers    int
 	queueSize  int
 	queueBlock bool
-	jobQueue   chan mirrorJob
-	workersWg  sync.WaitGroup
+
+	walPath        string
+	walSegmentSize int64
+	walFsync       string
+	theWAL         *wal
+
+	bodySpillThreshold int64
+	maxBodyBytes       int64
+
+	activeRetryPolicy retryPolicy
+
+	breakerWindowSize     int
+	breakerThreshold      float64
+	breakerCooldown       time.Duration
+	breakerHalfOpenProbes int
+
+	shutdownTimeout time.Duration
 )
 
 // ---------- Worker-Pool ----------
@@ -58,41 +58,31 @@ type mirrorJob struct {
 	method  string
 	path    string
 	headers string
-	body    []byte
-}
-
-func startWorkerPool(n int, jobs <-chan mirrorJob) {
-	workersWg.Add(n)
-	for i := 0; i < n; i++ {
-		go func(id int) {
-			defer workersWg.Done()
-			if debug {
-				log.Printf("[worker %d] started", id)
-			}
-			for job := range jobs {
-				makeHTTPRequest(job.method, job.path, job.headers, job.body)
-			}
-			if debug {
-				log.Printf("[worker %d] stopped", id)
-			}
-		}(i + 1)
-	}
-}
 
-func enqueue(job mirrorJob) {
-	if queueBlock {
-		// backpressure: block, when queue full
-		jobQueue <- job
-		return
-	}
-	// non-blocking
-	select {
-	case jobQueue <- job:
-	default:
-		if debug {
-			log.Printf("queue full (size=%d): dropping mirror job %s %s", queueSize, job.method, job.path)
-		}
-	}
+	// body holds the request body in memory; bodyFile names a temp
+	// file holding it instead once it exceeds -body-spill-threshold.
+	// bodySize is the total body size regardless of which is used.
+	// bodyRef counts down the backends (and their retries) still
+	// reading bodyFile, so it is only removed once nobody needs it.
+	body     []byte
+	bodyFile string
+	bodySize int64
+	bodyRef  *bodyRefCounter
+
+	// seq and enqueuedAt are only populated when the WAL is enabled;
+	// they let the job be acked once every backend is done with it.
+	seq        uint64
+	enqueuedAt time.Time
+
+	// ack tracks how many backends this job was fanned out to still
+	// need to report a terminal outcome (sent, retries exhausted or
+	// dropped) before the WAL entry can be acked.
+	ack *ackTracker
+
+	// attempt counts retries of this job against a single backend; it
+	// is not persisted to the WAL, since a retry is a per-backend
+	// delivery concern rather than a durability one.
+	attempt int
 }
 
 // ---------- main ----------
@@ -100,37 +90,80 @@ func enqueue(job mirrorJob) {
 func main() {
 	// Flags
 	listenAddrParam := flag.String("listen", "127.0.0.1:12345", "Address where the server should listen")
-	mirrorhostParam := flag.String("host", "", "Hostname where requests should be mirrored to (no trailing slash)")
+	legacyHostParam, backendSpecsParam, backendsConfigParam := registerBackendFlags()
 	debugParam := flag.Bool("debug", false, "Enable debug mode")
 	verboseParam := flag.Bool("verbose", false, "Enable verbose mode")
 
-	workersParam := flag.Int("workers", runtime.NumCPU()*4, "Number of parallel workers")
-	queueSizeParam := flag.Int("queue-size", 10000, "Size of the worker queue")
-	queueBlockParam := flag.Bool("queue-block", false, "Block when queue is full instead of dropping")
+	workersParam := flag.Int("workers", runtime.NumCPU()*4, "Default number of parallel workers per backend")
+	queueSizeParam := flag.Int("queue-size", 10000, "Default size of a backend's worker queue")
+	queueBlockParam := flag.Bool("queue-block", false, "Block when a backend's queue is full instead of dropping")
+
+	walPathParam := flag.String("wal-path", "", "Directory for the mirror job write-ahead log (disabled if empty)")
+	walSegmentSizeParam := flag.Int64("wal-segment-size", 64*1024*1024, "Max size in bytes of a single WAL segment before rotation")
+	walFsyncParam := flag.String("wal-fsync", "interval", "WAL fsync policy: always|interval|never")
+
+	bodySpillThresholdParam := flag.Int64("body-spill-threshold", 256*1024, "Bodies larger than this many bytes are spilled to a temp file instead of held in memory (0 disables spilling)")
+	maxBodyBytesParam := flag.Int64("max-body-bytes", 0, "Drop mirror jobs whose body exceeds this many bytes (0 = no limit)")
+
+	adminListenParam := registerAdminFlags()
+
+	retryMaxParam, retryBaseDelayParam, retryMaxDelayParam, retryOnParam := registerRetryFlags()
+	breakerWindowParam, breakerThresholdParam, breakerCooldownParam, breakerHalfOpenProbesParam := registerBreakerFlags()
+
+	shutdownTimeoutParam := registerShutdownFlags()
 
 	flag.Parse()
 
 	listenAddr = *listenAddrParam
-	mirrorhost = *mirrorhostParam
 	debug = *debugParam
 	verbose = *verboseParam
 	workers = *workersParam
 	queueSize = *queueSizeParam
 	queueBlock = *queueBlockParam
+	walPath = *walPathParam
+	walSegmentSize = *walSegmentSizeParam
+	walFsync = *walFsyncParam
+	bodySpillThreshold = *bodySpillThresholdParam
+	maxBodyBytes = *maxBodyBytesParam
+	adminListenAddr = *adminListenParam
+
+	if err := validateBreakerWindow(*breakerWindowParam); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	breakerWindowSize = *breakerWindowParam
+	breakerThreshold = *breakerThresholdParam
+	breakerCooldown = *breakerCooldownParam
+	breakerHalfOpenProbes = *breakerHalfOpenProbesParam
+	shutdownTimeout = *shutdownTimeoutParam
+
+	policy, err := parseRetryPolicy(*retryMaxParam, *retryBaseDelayParam, *retryMaxDelayParam, *retryOnParam)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	activeRetryPolicy = policy
 
-	// Validate mirrorhost
-	if mirrorhost == "" {
-		log.Fatal("Error: Hostname is required")
+	backendCfgs, err := resolveBackendConfigs(*legacyHostParam, *backendSpecsParam, *backendsConfigParam)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if len(backendCfgs) == 0 {
+		log.Fatal("Error: at least one mirror backend is required (-host, -backend or -backends-config)")
 	}
-	if strings.HasSuffix(mirrorhost, "/") {
-		log.Fatal("Error: Hostname must not end with a trailing slash")
+	for _, cfg := range backendCfgs {
+		runner, err := newBackendRunner(cfg)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		backendRunners = append(backendRunners, runner)
 	}
 
 	// Infos
 	fmt.Printf("Listening on: %s\n", listenAddr)
-	fmt.Printf("Mirroring requests to: %s\n", mirrorhost)
-	fmt.Printf("Worker pool: %d workers, queue-size=%d, queue-block=%v, GOMAXPROCS=%d\n",
-		workers, queueSize, queueBlock, runtime.GOMAXPROCS(0))
+	for _, r := range backendRunners {
+		fmt.Printf("Mirroring to backend %q: %s (weight=%.3g, sample=%.3g, workers=%d, queue-size=%d)\n",
+			r.backend.Name(), r.backend.(*httpBackend).baseURL, r.weight, r.sampleRate, r.workers, r.queueSize)
+	}
+	fmt.Printf("GOMAXPROCS=%d\n", runtime.GOMAXPROCS(0))
 
 	// Listener
 	listener, err := net.Listen("tcp4", listenAddr)
@@ -140,23 +173,62 @@ func main() {
 	}
 	defer listener.Close()
 
-	// start worker-queue + pool
-	jobQueue = make(chan mirrorJob, queueSize)
-	startWorkerPool(workers, jobQueue)
+	startAdminServer(adminListenAddr)
+
+	if walPath != "" {
+		policy, err := parseFsyncPolicy(walFsync)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		theWAL, err = openWAL(walPath, walSegmentSize, policy)
+		if err != nil {
+			log.Fatalf("Error opening WAL at %s: %v", walPath, err)
+		}
+
+		// Spilled bodies must survive as long as the WAL entry
+		// pointing at them, so they live under -wal-path rather than
+		// the default os.TempDir().
+		bodySpillDir = filepath.Join(walPath, "bodies")
+		if err := os.MkdirAll(bodySpillDir, 0o755); err != nil {
+			log.Fatalf("Error creating body spill dir %s: %v", bodySpillDir, err)
+		}
+		pending := theWAL.replayPending(queueSize)
+		for _, job := range pending {
+			fanOut(job)
+		}
+		if len(pending) > 0 {
+			fmt.Printf("Replayed %d pending mirror job(s) from WAL at %s\n", len(pending), walPath)
+		}
+	}
+
+	for _, r := range backendRunners {
+		r.run()
+	}
+
+	go waitForShutdownSignal(listener)
 
 	// SPOE-Agent
 	a := agent.New(handler, logger.NewDefaultLog())
-	if err := a.Serve(listener); err != nil {
+	if err := a.Serve(listener); err != nil && !isShuttingDown() {
 		log.Printf("error agent serve: %+v\n", err)
 	}
 
-	close(jobQueue)
-	workersWg.Wait()
+	drainAndClose(shutdownTimeout)
+
+	if theWAL != nil {
+		if err := theWAL.close(); err != nil {
+			log.Printf("error closing WAL: %v", err)
+		}
+	}
 }
 
 // ---------- SPOE handler ----------
 
 func handler(req *request.Request) {
+	atomic.AddUint64(&spoeFramesHandledTotal, 1)
+	if isShuttingDown() {
+		return
+	}
 	if debug {
 		log.Printf("handle request EngineID: '%s', StreamID: '%d', FrameID: '%d' with %d messages\n", req.EngineID, req.StreamID, req.FrameID, req.Messages.Len())
 	}
@@ -171,24 +243,28 @@ func handler(req *request.Request) {
 
 	method, found := mes.KV.Get("arg_method")
 	if !found {
+		atomic.AddUint64(&spoeMissingArgsTotal, 1)
 		log.Printf("arg_method not found in message")
 		return
 	}
 
 	path, found := mes.KV.Get("arg_path")
 	if !found {
+		atomic.AddUint64(&spoeMissingArgsTotal, 1)
 		log.Printf("arg_path not found in message")
 		return
 	}
 
 	hdrs, found := mes.KV.Get("arg_hdrs")
 	if !found {
+		atomic.AddUint64(&spoeMissingArgsTotal, 1)
 		log.Printf("arg_hdrs not found in message")
 		return
 	}
 
 	body, found := mes.KV.Get("arg_body")
 	if !found {
+		atomic.AddUint64(&spoeMissingArgsTotal, 1)
 		log.Printf("arg_body not found in message")
 		return
 	}
@@ -198,7 +274,7 @@ func handler(req *request.Request) {
 	bodyBytes := body.([]byte)
 
 	if verbose {
-		log.Printf("SPOA-MIRROR %s %s - %s %s - %s\n", methodString, pathString, mirrorhost, listenAddr, string(bodyBytes))
+		log.Printf("SPOA-MIRROR %s %s - %s - %s\n", methodString, pathString, listenAddr, string(bodyBytes))
 	}
 
 	var hdrsString string
@@ -213,56 +289,14 @@ func handler(req *request.Request) {
 		return
 	}
 
-	bodyCopy := make([]byte, len(bodyBytes))
-	copy(bodyCopy, bodyBytes)
-
-	enqueue(mirrorJob{
+	job := mirrorJob{
 		method:  methodString,
 		path:    pathString,
 		headers: hdrsString,
-		body:    bodyCopy,
-	})
-}
-
-// ---------- HTTP Mirror Request ----------
-
-func makeHTTPRequest(reqMethod string, reqPath string, reqHeaders string, reqBody []byte) {
-	req, err := http.NewRequest(reqMethod, mirrorhost+reqPath, bytes.NewReader(reqBody))
-	if err != nil {
-		log.Printf("Error creating request: %v\n", err)
-		return
 	}
-
-	sc := bufio.NewScanner(strings.NewReader(reqHeaders))
-	for sc.Scan() {
-		header := sc.Text()
-		if header == "" {
-			continue
-		}
-		parts := strings.SplitN(header, ": ", 2)
-		if len(parts) != 2 {
-			if debug {
-				log.Printf("Invalid header format: %q", header)
-			}
-			continue
-		}
-		key := parts[0]
-		value := parts[1]
-		req.Header.Set(key, value)
-	}
-	if err := sc.Err(); err != nil && debug {
-		log.Printf("scanner error on headers: %v", err)
-	}
-
-	// HTTP Call
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		log.Printf("Error making HTTP request: %v\n", err)
+	if !prepareBody(&job, bodyBytes) {
 		return
 	}
-	defer resp.Body.Close()
 
-	if verbose {
-		log.Printf("SPOA-MIRROR HTTP %s %s -> %d", reqMethod, req.URL, resp.StatusCode)
-	}
+	dispatch(job)
 }
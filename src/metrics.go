@@ -0,0 +1,236 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ---------- Metrics & admin endpoint ----------
+//
+// -admin-listen starts a second HTTP server exposing /metrics in
+// Prometheus text format and the standard net/http/pprof handlers, so
+// operators running with -queue-block=false can see drop rates and
+// tail latency of the mirrored side, and profile the worker pool under
+// load. The counters below are hand-rolled rather than pulling in the
+// Prometheus client library: the pipeline only needs a handful of
+// counters/gauges and one histogram, and the rest of this codebase
+// already favors plain atomics over a metrics dependency.
+
+var adminListenAddr string
+
+var (
+	jobsEnqueuedTotal uint64
+	jobsDroppedTotal  = newLabeledCounter()
+
+	bodiesSpilledTotal uint64
+
+	httpRequestsTotal = newLabeledCounter()
+	httpDuration      = newLabeledHistogram(0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+
+	spoeFramesHandledTotal uint64
+	spoeMissingArgsTotal   uint64
+
+	retriesTotal = newLabeledCounter()
+)
+
+// labeledCounter is a counter broken down by a label set, keyed by the
+// already-formatted `key="value",...` label string.
+type labeledCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func newLabeledCounter() *labeledCounter {
+	return &labeledCounter{counts: make(map[string]uint64)}
+}
+
+func (c *labeledCounter) inc(labels string) {
+	c.mu.Lock()
+	c.counts[labels]++
+	c.mu.Unlock()
+}
+
+func (c *labeledCounter) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.counts))
+	for k, v := range c.counts {
+		out[k] = v
+	}
+	return out
+}
+
+// labeledHistogram tracks observation counts/sums per label set against
+// a fixed set of upper-bound buckets, matching the Prometheus
+// cumulative-histogram exposition format.
+type labeledHistogram struct {
+	buckets []float64
+
+	mu   sync.Mutex
+	data map[string]*histogramData
+}
+
+type histogramData struct {
+	bucketCounts []uint64
+	count        uint64
+	sum          float64
+}
+
+func newLabeledHistogram(buckets ...float64) *labeledHistogram {
+	return &labeledHistogram{buckets: buckets, data: make(map[string]*histogramData)}
+}
+
+func (h *labeledHistogram) observe(labels string, seconds float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.data[labels]
+	if !ok {
+		d = &histogramData{bucketCounts: make([]uint64, len(h.buckets))}
+		h.data[labels] = d
+	}
+	d.count++
+	d.sum += seconds
+	for i, upper := range h.buckets {
+		if seconds <= upper {
+			d.bucketCounts[i]++
+		}
+	}
+}
+
+func (h *labeledHistogram) snapshot() map[string]histogramData {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]histogramData, len(h.data))
+	for k, d := range h.data {
+		cp := *d
+		cp.bucketCounts = append([]uint64(nil), d.bucketCounts...)
+		out[k] = cp
+	}
+	return out
+}
+
+// registerAdminFlags wires the -admin-listen flag.
+func registerAdminFlags() *string {
+	return flag.String("admin-listen", "", "Address for the /metrics and pprof admin endpoint (disabled if empty)")
+}
+
+// startAdminServer starts the admin HTTP server in the background. It
+// never returns an error: a failure to bind is logged and the process
+// keeps running without metrics/pprof rather than aborting the mirror.
+func startAdminServer(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		log.Printf("admin endpoint listening on %s (/metrics, /debug/pprof/)", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("admin endpoint stopped: %v", err)
+		}
+	}()
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	var b strings.Builder
+	writeCounter(&b, "spoa_mirror_jobs_enqueued_total", "Mirror jobs accepted from the SPOE agent.", atomic.LoadUint64(&jobsEnqueuedTotal))
+	writeLabeledCounter(&b, "spoa_mirror_jobs_dropped_total", "Mirror jobs dropped instead of being sent to a backend.", jobsDroppedTotal)
+	writeCounter(&b, "spoa_mirror_bodies_spilled_total", "Request bodies spilled to a temp file instead of held in memory.", atomic.LoadUint64(&bodiesSpilledTotal))
+
+	fmt.Fprintf(&b, "# HELP spoa_mirror_queue_depth Current number of mirror jobs queued per backend.\n# TYPE spoa_mirror_queue_depth gauge\n")
+	for _, br := range backendRunners {
+		fmt.Fprintf(&b, "spoa_mirror_queue_depth{backend=%q} %d\n", br.backend.Name(), len(br.queue))
+	}
+
+	fmt.Fprintf(&b, "# HELP spoa_mirror_worker_busy Number of workers currently sending a mirror job, per backend.\n# TYPE spoa_mirror_worker_busy gauge\n")
+	for _, br := range backendRunners {
+		fmt.Fprintf(&b, "spoa_mirror_worker_busy{backend=%q} %d\n", br.backend.Name(), atomic.LoadInt64(&br.busyWorkers))
+	}
+
+	writeLabeledCounter(&b, "spoa_mirror_http_requests_total", "HTTP requests made to mirror targets.", httpRequestsTotal)
+	writeHistogram(&b, "spoa_mirror_http_duration_seconds", "Latency of HTTP requests made to mirror targets.", httpDuration)
+	writeLabeledCounter(&b, "spoa_mirror_retries_total", "Mirror jobs requeued for a retry attempt.", retriesTotal)
+
+	fmt.Fprintf(&b, "# HELP spoa_mirror_breaker_state Circuit breaker state per backend (0=closed, 1=open, 2=half_open).\n# TYPE spoa_mirror_breaker_state gauge\n")
+	for _, br := range backendRunners {
+		fmt.Fprintf(&b, "spoa_mirror_breaker_state{backend=%q} %d\n", br.backend.Name(), br.breaker.snapshot())
+	}
+
+	writeCounter(&b, "spoa_mirror_spoe_frames_handled_total", "SPOE frames handled by the agent.", atomic.LoadUint64(&spoeFramesHandledTotal))
+	writeCounter(&b, "spoa_mirror_spoe_messages_missing_args_total", "SPOE \"mirror\" messages missing a required argument.", atomic.LoadUint64(&spoeMissingArgsTotal))
+
+	w.Write([]byte(b.String()))
+}
+
+func writeCounter(b *strings.Builder, name, help string, v uint64) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+}
+
+func writeLabeledCounter(b *strings.Builder, name, help string, c *labeledCounter) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	snap := c.snapshot()
+	for _, labels := range sortedKeys(snap) {
+		fmt.Fprintf(b, "%s{%s} %d\n", name, labels, snap[labels])
+	}
+}
+
+// writeHistogram renders h in Prometheus cumulative-bucket format. Every
+// observe call (see backendRunner.run) passes at least a "backend" label, so
+// labels is never empty and the ",le=" separator is always safe.
+// d.bucketCounts[i] is already the cumulative count of observations <=
+// that bucket's upper bound (see labeledHistogram.observe), so it is
+// emitted as-is rather than re-accumulated here.
+func writeHistogram(b *strings.Builder, name, help string, h *labeledHistogram) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	snap := h.snapshot()
+	for _, labels := range sortedHistKeys(snap) {
+		d := snap[labels]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, upper, d.bucketCounts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, d.count)
+		fmt.Fprintf(b, "%s_sum{%s} %g\n", name, labels, d.sum)
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, d.count)
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedHistKeys(m map[string]histogramData) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func labelPair(key, value string) string {
+	return fmt.Sprintf("%s=%q", key, value)
+}
+
+func joinLabels(pairs ...string) string {
+	return strings.Join(pairs, ",")
+}
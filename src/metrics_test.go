@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestHistogramObserveIsCumulative guards against re-accumulating an
+// already-cumulative bucketCounts slice: observe stores, for each
+// bucket, the count of observations <= that bucket's upper bound, so
+// writeHistogram must emit those counts as-is.
+func TestHistogramObserveIsCumulative(t *testing.T) {
+	h := newLabeledHistogram(0.1, 0.5, 10)
+	h.observe("backend=\"x\"", 0.05)
+
+	d := h.snapshot()["backend=\"x\""]
+	want := []uint64{1, 1, 1}
+	for i, w := range want {
+		if d.bucketCounts[i] != w {
+			t.Fatalf("bucketCounts[%d] = %d, want %d", i, d.bucketCounts[i], w)
+		}
+	}
+	if d.count != 1 {
+		t.Fatalf("count = %d, want 1", d.count)
+	}
+}
+
+// TestWriteHistogramRendersCumulativeBuckets guards against the bug
+// where writeHistogram re-ran a running sum over observe's already
+// cumulative bucketCounts, inflating every bucket after the first.
+func TestWriteHistogramRendersCumulativeBuckets(t *testing.T) {
+	h := newLabeledHistogram(0.1, 0.5, 10)
+	h.observe("backend=\"x\"", 0.05)
+
+	var b strings.Builder
+	writeHistogram(&b, "spoa_mirror_http_duration_seconds", "help", h)
+	out := b.String()
+
+	cases := []string{
+		`spoa_mirror_http_duration_seconds_bucket{backend="x",le="0.1"} 1`,
+		`spoa_mirror_http_duration_seconds_bucket{backend="x",le="0.5"} 1`,
+		`spoa_mirror_http_duration_seconds_bucket{backend="x",le="10"} 1`,
+		`spoa_mirror_http_duration_seconds_bucket{backend="x",le="+Inf"} 1`,
+		`spoa_mirror_http_duration_seconds_count{backend="x"} 1`,
+	}
+	for _, want := range cases {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing line %q, got:\n%s", want, out)
+		}
+	}
+}
+
+// TestWriteLabeledCounterRendersEachLabelSet guards the plain
+// labeled-counter rendering path alongside the histogram fix above.
+func TestWriteLabeledCounterRendersEachLabelSet(t *testing.T) {
+	c := newLabeledCounter()
+	c.inc(`backend="a"`)
+	c.inc(`backend="a"`)
+	c.inc(`backend="b"`)
+
+	var b strings.Builder
+	writeLabeledCounter(&b, "spoa_mirror_jobs_dropped_total", "help", c)
+	out := b.String()
+
+	if !strings.Contains(out, `spoa_mirror_jobs_dropped_total{backend="a"} 2`) {
+		t.Errorf("output missing backend=a count, got:\n%s", out)
+	}
+	if !strings.Contains(out, `spoa_mirror_jobs_dropped_total{backend="b"} 1`) {
+		t.Errorf("output missing backend=b count, got:\n%s", out)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Retry & circuit breaker ----------
+//
+// httpBackend.Send used to give up after the first transport error or
+// non-2xx response and the job was silently lost. A failure that
+// matches -retry-on is now requeued with jittered exponential backoff
+// (capped by -retry-max attempts) via a time.AfterFunc timer, so a
+// retry never blocks the worker that hit the failure. Each backend
+// also carries its own circuitBreaker: once its rolling failure ratio
+// crosses -breaker-threshold it opens for -breaker-cooldown (new jobs
+// are fast-dropped), then half-opens to probe the target with a
+// handful of requests before deciding whether to close again.
+
+// retryPolicy decides whether a failed send qualifies for another
+// attempt and how long to wait before making it.
+type retryPolicy struct {
+	max       int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+
+	retry5xx   bool
+	retry429   bool
+	retryOnErr bool
+}
+
+func registerRetryFlags() (max *int, baseDelay, maxDelay *time.Duration, on *string) {
+	max = flag.Int("retry-max", 0, "Max retry attempts for a failed mirror job (0 disables retry)")
+	baseDelay = flag.Duration("retry-base-delay", 100*time.Millisecond, "Base delay before the first retry")
+	maxDelay = flag.Duration("retry-max-delay", 10*time.Second, "Cap on the backoff delay between retries")
+	on = flag.String("retry-on", "5xx,429,conn", "Comma-separated failure classes to retry: 5xx, 429, conn")
+	return
+}
+
+// parseRetryPolicy turns the -retry-* flag values into a retryPolicy.
+func parseRetryPolicy(max int, baseDelay, maxDelay time.Duration, on string) (retryPolicy, error) {
+	p := retryPolicy{max: max, baseDelay: baseDelay, maxDelay: maxDelay}
+	for _, tok := range strings.Split(on, ",") {
+		switch strings.TrimSpace(tok) {
+		case "":
+		case "5xx":
+			p.retry5xx = true
+		case "429":
+			p.retry429 = true
+		case "conn":
+			p.retryOnErr = true
+		default:
+			return p, fmt.Errorf("unknown -retry-on class %q (want 5xx, 429 or conn)", tok)
+		}
+	}
+	return p, nil
+}
+
+// shouldRetry reports whether a job that came back with code/err on
+// its attempt'th try (0-indexed) qualifies for another attempt.
+func (p retryPolicy) shouldRetry(code int, err error, attempt int) bool {
+	if attempt >= p.max {
+		return false
+	}
+	if err != nil {
+		return p.retryOnErr
+	}
+	if code >= 500 && code < 600 {
+		return p.retry5xx
+	}
+	if code == 429 {
+		return p.retry429
+	}
+	return false
+}
+
+// backoff returns the jittered delay before the (0-indexed) attempt'th
+// retry: base*2^attempt, capped at maxDelay, with full jitter.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay
+	for i := 0; i < attempt && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// ---------- circuit breaker ----------
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func registerBreakerFlags() (window *int, threshold *float64, cooldown *time.Duration, halfOpenProbes *int) {
+	window = flag.Int("breaker-window", 20, "Number of recent requests a backend's circuit breaker considers")
+	threshold = flag.Float64("breaker-threshold", 0.5, "Failure ratio within -breaker-window that opens a backend's circuit breaker")
+	cooldown = flag.Duration("breaker-cooldown", 30*time.Second, "How long an open circuit breaker stays open before probing the target again")
+	halfOpenProbes = flag.Int("breaker-half-open-probes", 5, "Requests let through while a circuit breaker is half-open, deciding whether to close or reopen")
+	return
+}
+
+// circuitBreaker tracks a rolling window of send outcomes for one
+// backend and fast-drops jobs once the failure ratio within that
+// window crosses threshold, giving the target cooldown to recover.
+type circuitBreaker struct {
+	windowSize     int
+	threshold      float64
+	cooldown       time.Duration
+	halfOpenProbes int
+
+	mu              sync.Mutex
+	state           breakerState
+	outcomes        []bool // ring buffer of success(true)/failure(false)
+	pos             int
+	filled          int
+	openedAt        time.Time
+	probesLeft      int
+	probesSucceeded int
+}
+
+// newCircuitBreaker panics if windowSize is negative, and a zero windowSize
+// makes the breaker's first record() call panic: validateBreakerWindow
+// must be called on the flag value before this, the same way -wal-fsync and
+// -retry-on are validated before their parsed values are used.
+func newCircuitBreaker(windowSize int, threshold float64, cooldown time.Duration, halfOpenProbes int) *circuitBreaker {
+	return &circuitBreaker{
+		windowSize:     windowSize,
+		threshold:      threshold,
+		cooldown:       cooldown,
+		halfOpenProbes: halfOpenProbes,
+		outcomes:       make([]bool, windowSize),
+	}
+}
+
+// validateBreakerWindow rejects a non-positive -breaker-window: zero
+// leaves the ring buffer backing a circuitBreaker empty, so the first
+// record() call panics a worker goroutine, and a negative size panics
+// newCircuitBreaker itself, rather than either returning an error.
+func validateBreakerWindow(window int) error {
+	if window <= 0 {
+		return fmt.Errorf("-breaker-window must be > 0 (got %d)", window)
+	}
+	return nil
+}
+
+// allow reports whether a job may be sent right now. An open breaker
+// transitions to half-open once cooldown has elapsed and then lets
+// halfOpenProbes requests through to test the target.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probesLeft = b.halfOpenProbes
+		b.probesSucceeded = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probesLeft <= 0 {
+			return false
+		}
+		b.probesLeft--
+		return true
+	default:
+		return true
+	}
+}
+
+// record feeds a job's outcome into the breaker and updates its state.
+// While half-open, a single failed probe reopens the breaker right
+// away, but a success only closes it once every one of halfOpenProbes
+// has come back successful - a lone lucky probe isn't enough
+// confidence that the target has actually recovered.
+func (b *circuitBreaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		if !success {
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+			return
+		}
+		b.probesSucceeded++
+		if b.probesSucceeded >= b.halfOpenProbes {
+			b.state = breakerClosed
+			b.pos, b.filled = 0, 0
+		}
+		return
+	}
+
+	b.outcomes[b.pos] = success
+	b.pos = (b.pos + 1) % b.windowSize
+	if b.filled < b.windowSize {
+		b.filled++
+	}
+	if b.state == breakerOpen || b.filled < b.windowSize {
+		return
+	}
+
+	failures := 0
+	for _, ok := range b.outcomes[:b.filled] {
+		if !ok {
+			failures++
+		}
+	}
+	if float64(failures)/float64(b.filled) >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) snapshot() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
@@ -0,0 +1,120 @@
+package main
+
+import "testing"
+
+// TestValidateBreakerWindow guards against a zero or negative
+// -breaker-window reaching newCircuitBreaker, where a zero window would
+// panic the first worker goroutine that calls record() and a negative
+// one would panic newCircuitBreaker, instead of failing startup with a
+// clear error.
+func TestValidateBreakerWindow(t *testing.T) {
+	cases := []struct {
+		window  int
+		wantErr bool
+	}{
+		{window: 20, wantErr: false},
+		{window: 1, wantErr: false},
+		{window: 0, wantErr: true},
+		{window: -5, wantErr: true},
+	}
+	for _, c := range cases {
+		err := validateBreakerWindow(c.window)
+		if (err != nil) != c.wantErr {
+			t.Errorf("validateBreakerWindow(%d) error = %v, wantErr %v", c.window, err, c.wantErr)
+		}
+	}
+}
+
+// TestCircuitBreakerOpensAtThreshold guards the threshold edge case:
+// the breaker must stay closed until it has a full window of samples,
+// and only open once the failure ratio reaches (not merely
+// approaches) the configured threshold.
+func TestCircuitBreakerOpensAtThreshold(t *testing.T) {
+	b := newCircuitBreaker(4, 0.5, 0, 1)
+
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	if b.snapshot() != breakerClosed {
+		t.Fatalf("breaker opened before its window filled")
+	}
+
+	b.record(false) // window now 2/4 failures = 0.5, at threshold
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("breaker did not open once failure ratio reached threshold")
+	}
+}
+
+// TestCircuitBreakerHalfOpenRecovers guards the half-open -> closed ->
+// open transitions: a cooldown of 0 makes the breaker probe
+// immediately, a successful probe must close it and reset its window,
+// and a failed probe must reopen it.
+func TestCircuitBreakerHalfOpenRecovers(t *testing.T) {
+	b := newCircuitBreaker(2, 0.5, 0, 1)
+	b.record(false)
+	b.record(false)
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("breaker should be open after two failures on a window of 2")
+	}
+
+	if !b.allow() {
+		t.Fatalf("breaker should let a probe through once cooldown (0) has elapsed")
+	}
+	b.record(true)
+	if b.snapshot() != breakerClosed {
+		t.Fatalf("breaker should close after a successful half-open probe")
+	}
+
+	b.record(false)
+	b.record(false)
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("breaker should reopen on failures after closing")
+	}
+	b.allow() // consume the half-open probe
+	b.record(false)
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("breaker should reopen after a failed half-open probe")
+	}
+}
+
+// TestCircuitBreakerHalfOpenRequiresAllProbes guards against closing
+// on the first probe outcome regardless of -breaker-half-open-probes:
+// with 3 configured, the breaker must stay half-open through two
+// successes and only close once the third also succeeds, while a
+// single failed probe anywhere in the run reopens it immediately.
+func TestCircuitBreakerHalfOpenRequiresAllProbes(t *testing.T) {
+	b := newCircuitBreaker(2, 0.5, 0, 3)
+	b.record(false)
+	b.record(false)
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("breaker should be open after two failures on a window of 2")
+	}
+
+	b.allow()
+	b.record(true)
+	if b.snapshot() != breakerHalfOpen {
+		t.Fatalf("breaker should stay half-open after only 1 of 3 probes succeeded")
+	}
+
+	b.allow()
+	b.record(true)
+	if b.snapshot() != breakerHalfOpen {
+		t.Fatalf("breaker should stay half-open after only 2 of 3 probes succeeded")
+	}
+
+	b.allow()
+	b.record(true)
+	if b.snapshot() != breakerClosed {
+		t.Fatalf("breaker should close once all 3 probes succeeded")
+	}
+
+	b.record(false)
+	b.record(false)
+	b.allow()
+	b.record(true)
+	b.allow()
+	b.record(false)
+	if b.snapshot() != breakerOpen {
+		t.Fatalf("a single failed probe should reopen the breaker even mid-run")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ---------- Graceful shutdown ----------
+//
+// main used to close every backend's queue and wait only after
+// a.Serve returned, and nothing ever stopped a.Serve itself, so a
+// SIGTERM from an orchestrator terminated in-flight mirrors abruptly.
+// A signal now closes the SPOE listener (so a.Serve returns and no new
+// frames are accepted), flips shuttingDown so handler() stops
+// enqueueing new jobs, then drains every backend's queue for up to
+// -shutdown-timeout - logging progress as it goes - before the shared
+// request context's deadline cancels whatever mirror is still in
+// flight and the runners are closed down.
+
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+func registerShutdownFlags() *time.Duration {
+	return flag.Duration("shutdown-timeout", 30*time.Second, "Time to drain queued mirror jobs after a shutdown signal before cancelling them")
+}
+
+// requestCtxBox lets the current request context be swapped out from
+// under the backend workers once a drain deadline is known, without
+// requiring atomic.Value's "always the same concrete type" restriction
+// on context.Context itself.
+type requestCtxBox struct{ ctx context.Context }
+
+var currentRequestCtx atomic.Value
+
+func init() {
+	currentRequestCtx.Store(requestCtxBox{context.Background()})
+}
+
+func requestContext() context.Context {
+	return currentRequestCtx.Load().(requestCtxBox).ctx
+}
+
+// waitForShutdownSignal blocks until SIGINT/SIGTERM, then stops the
+// SPOE listener so agent.Serve returns and accepts no further frames.
+func waitForShutdownSignal(listener net.Listener) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	sig := <-sigCh
+	log.Printf("received %s, shutting down: no longer accepting new SPOE frames", sig)
+	atomic.StoreInt32(&shuttingDown, 1)
+	listener.Close()
+}
+
+// drainAndClose waits up to timeout for every backend's queue to
+// empty, logging remaining depth along the way, installs a context
+// whose deadline cancels any mirror requests still in flight once that
+// time is up, and then closes and waits for every backend's workers.
+func drainAndClose(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	currentRequestCtx.Store(requestCtxBox{ctx})
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		depth := totalQueueDepth()
+		if depth == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("shutdown-timeout elapsed with %d mirror job(s) still queued; cancelling in-flight requests", depth)
+			break
+		}
+		log.Printf("draining: %d mirror job(s) still queued", depth)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, r := range backendRunners {
+		r.close()
+	}
+	for _, r := range backendRunners {
+		r.wg.Wait()
+	}
+}
+
+func totalQueueDepth() int {
+	depth := 0
+	for _, r := range backendRunners {
+		depth += len(r.queue)
+	}
+	return depth
+}
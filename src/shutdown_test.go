@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestScheduleRetryAfterCloseDoesNotPanic guards against a retry
+// timer firing after close() has already torn down a backend's queue:
+// it must drop the job instead of sending on a closed channel. The
+// test calls enqueue directly, which is all scheduleRetry's timer does
+// when it fires.
+func TestScheduleRetryAfterCloseDoesNotPanic(t *testing.T) {
+	r := &backendRunner{
+		backend: &httpBackend{name: "test"},
+		queue:   make(chan mirrorJob, 1),
+		retry:   retryPolicy{max: 1, baseDelay: 0, maxDelay: 0, retry5xx: true},
+	}
+
+	r.close()
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			t.Fatalf("enqueue on a closed runner panicked: %v", rec)
+		}
+	}()
+	r.enqueue(mirrorJob{method: "GET", path: "/x"})
+}
+
+// TestCloseWaitsForInFlightEnqueue guards against close() racing an
+// enqueue call that has already been let past the closed check: close
+// must not close the channel until that send has landed.
+func TestCloseWaitsForInFlightEnqueue(t *testing.T) {
+	r := &backendRunner{
+		backend: &httpBackend{name: "test"},
+		queue:   make(chan mirrorJob, 1),
+	}
+
+	r.closeMu.Lock()
+	r.inFlight.Add(1) // simulate an enqueue that already passed the closed check
+	r.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("close() returned before the in-flight enqueue finished")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	r.queue <- mirrorJob{}
+	r.inFlight.Done()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("close() did not return after the in-flight enqueue finished")
+	}
+}
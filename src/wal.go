@@ -0,0 +1,648 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ---------- Write-ahead log ----------
+//
+// When -wal-path is set, every mirror job is appended to a segmented
+// on-disk log before it is fanned out to the backends' queues, and an
+// ack record is appended once every backend it went to is done with it
+// (see finalizeJob). A crash or restart therefore loses nothing that
+// was durably queued: on startup the tail of the log (bounded by
+// -queue-size) is fanned out to the backends again before the SPOE
+// agent starts accepting traffic. A background compactor
+// drops segments once every job they hold has been acked.
+
+const (
+	walRecordJob byte = 1
+	walRecordAck byte = 2
+
+	walSegmentPrefix = "wal-"
+	walSegmentSuffix = ".log"
+)
+
+type fsyncPolicy int
+
+const (
+	fsyncAlways fsyncPolicy = iota
+	fsyncInterval
+	fsyncNever
+)
+
+func parseFsyncPolicy(s string) (fsyncPolicy, error) {
+	switch s {
+	case "always":
+		return fsyncAlways, nil
+	case "interval":
+		return fsyncInterval, nil
+	case "never":
+		return fsyncNever, nil
+	default:
+		return 0, fmt.Errorf("unknown -wal-fsync policy %q (want always|interval|never)", s)
+	}
+}
+
+// walSegment is a single append-only log file plus the bookkeeping the
+// compactor needs to decide when the whole file can be deleted.
+type walSegment struct {
+	id   int
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+
+	jobSeqs  map[uint64]struct{} // job seqs written to this segment
+	ackedSeq map[uint64]struct{} // those jobs that are known acked
+}
+
+func (s *walSegment) fullyAcked() bool {
+	if len(s.jobSeqs) == 0 {
+		return false
+	}
+	for seq := range s.jobSeqs {
+		if _, ok := s.ackedSeq[seq]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+type wal struct {
+	mu         sync.Mutex
+	dir        string
+	maxSegSize int64
+	fsync      fsyncPolicy
+
+	nextSeq  uint64
+	cur      *walSegment
+	segments []*walSegment // oldest first
+
+	fsyncTicker *time.Ticker
+	stopCh      chan struct{}
+	wg          sync.WaitGroup
+}
+
+func openWAL(dir string, maxSegSize int64, policy fsyncPolicy) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("wal: create dir %s: %w", dir, err)
+	}
+	w := &wal{
+		dir:        dir,
+		maxSegSize: maxSegSize,
+		fsync:      policy,
+		nextSeq:    1,
+		stopCh:     make(chan struct{}),
+	}
+	if err := w.loadSegments(); err != nil {
+		return nil, err
+	}
+	if w.cur == nil {
+		if err := w.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	if policy == fsyncInterval {
+		w.fsyncTicker = time.NewTicker(time.Second)
+		w.wg.Add(1)
+		go w.fsyncLoop()
+	}
+	w.wg.Add(1)
+	go w.compactLoop()
+	return w, nil
+}
+
+func segmentPath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%08d%s", walSegmentPrefix, id, walSegmentSuffix))
+}
+
+func (w *wal) loadSegments() error {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return fmt.Errorf("wal: read dir %s: %w", w.dir, err)
+	}
+	var ids []int
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if !strings.HasPrefix(name, walSegmentPrefix) || !strings.HasSuffix(name, walSegmentSuffix) {
+			continue
+		}
+		idStr := strings.TrimSuffix(strings.TrimPrefix(name, walSegmentPrefix), walSegmentSuffix)
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		seg, err := w.replaySegment(id)
+		if err != nil {
+			return err
+		}
+		w.segments = append(w.segments, seg)
+	}
+
+	// An ack record lands in whichever segment is current at ack
+	// time, which may not be the segment holding the job it acks once
+	// rotation has happened in between - replaySegment only sees the
+	// records physically inside the segment it scanned, so it can't
+	// know that by itself. Reconcile acks across all segments here so
+	// a job's original segment still sees its ack and can eventually
+	// be compacted.
+	ackedSeqs := make(map[uint64]struct{})
+	for _, seg := range w.segments {
+		for seq := range seg.ackedSeq {
+			ackedSeqs[seq] = struct{}{}
+		}
+	}
+	for _, seg := range w.segments {
+		for seq := range seg.jobSeqs {
+			if _, acked := ackedSeqs[seq]; acked {
+				seg.ackedSeq[seq] = struct{}{}
+			}
+		}
+	}
+
+	if len(w.segments) > 0 {
+		w.cur = w.segments[len(w.segments)-1]
+	}
+	return nil
+}
+
+// replaySegment opens an existing segment file for appending and
+// rebuilds its job/ack bookkeeping by scanning its records.
+func (w *wal) replaySegment(id int) (*walSegment, error) {
+	path := segmentPath(w.dir, id)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("wal: open segment %s: %w", path, err)
+	}
+
+	seg := &walSegment{
+		id:       id,
+		path:     path,
+		f:        f,
+		jobSeqs:  make(map[uint64]struct{}),
+		ackedSeq: make(map[uint64]struct{}),
+	}
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		rec, n, err := readWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// Truncated tail record from a crash mid-write: stop
+			// replaying this segment here and drop the partial bytes.
+			log.Printf("wal: truncating segment %s at offset %d after short/corrupt record: %v", path, offset, err)
+			break
+		}
+		offset += n
+		switch rec.typ {
+		case walRecordJob:
+			seg.jobSeqs[rec.job.seq] = struct{}{}
+			if rec.job.seq >= w.nextSeq {
+				w.nextSeq = rec.job.seq + 1
+			}
+		case walRecordAck:
+			seg.ackedSeq[rec.ackSeq] = struct{}{}
+		}
+	}
+	if err := f.Truncate(offset); err != nil {
+		return nil, fmt.Errorf("wal: truncate segment %s: %w", path, err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("wal: seek segment %s: %w", path, err)
+	}
+	seg.size = offset
+	seg.w = bufio.NewWriter(f)
+	return seg, nil
+}
+
+// replayPending returns every job in the log that has not yet been
+// acked, in seq order, bounded to the most recent limit entries.
+func (w *wal) replayPending(limit int) []mirrorJob {
+	w.mu.Lock()
+	type pending struct {
+		seq uint64
+		job mirrorJob
+	}
+	var all []pending
+	for _, seg := range w.segments {
+		f, err := os.Open(seg.path)
+		if err != nil {
+			continue
+		}
+		r := bufio.NewReader(f)
+		for {
+			rec, _, err := readWALRecord(r)
+			if err != nil {
+				break
+			}
+			if rec.typ != walRecordJob {
+				continue
+			}
+			if _, acked := seg.ackedSeq[rec.job.seq]; acked {
+				continue
+			}
+			all = append(all, pending{seq: rec.job.seq, job: rec.job})
+		}
+		f.Close()
+	}
+	w.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	if len(all) > limit {
+		log.Printf("wal: replay found %d pending jobs, keeping most recent %d (bounded by -queue-size)", len(all), limit)
+		all = all[len(all)-limit:]
+	}
+	jobs := make([]mirrorJob, len(all))
+	for i, p := range all {
+		jobs[i] = p.job
+	}
+	return jobs
+}
+
+func (w *wal) rotate() error {
+	id := 0
+	if w.cur != nil {
+		id = w.cur.id + 1
+		if err := w.cur.w.Flush(); err != nil {
+			return fmt.Errorf("wal: flush segment %s: %w", w.cur.path, err)
+		}
+		if err := w.cur.f.Close(); err != nil {
+			return fmt.Errorf("wal: close segment %s: %w", w.cur.path, err)
+		}
+	}
+	path := segmentPath(w.dir, id)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: create segment %s: %w", path, err)
+	}
+	seg := &walSegment{
+		id:       id,
+		path:     path,
+		f:        f,
+		w:        bufio.NewWriter(f),
+		jobSeqs:  make(map[uint64]struct{}),
+		ackedSeq: make(map[uint64]struct{}),
+	}
+	w.segments = append(w.segments, seg)
+	w.cur = seg
+	return nil
+}
+
+// append assigns the job its sequence number and timestamp, writes it
+// to the current segment (rotating first if it is full) and returns
+// the now-durable job.
+func (w *wal) append(job mirrorJob) (mirrorJob, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	job.seq = w.nextSeq
+	w.nextSeq++
+	job.enqueuedAt = time.Now()
+
+	if w.cur.size >= w.maxSegSize {
+		if err := w.rotate(); err != nil {
+			return job, err
+		}
+	}
+
+	n, err := writeWALRecord(w.cur.w, walRecord{typ: walRecordJob, job: job})
+	if err != nil {
+		return job, fmt.Errorf("wal: append job %d: %w", job.seq, err)
+	}
+	w.cur.size += n
+	w.cur.jobSeqs[job.seq] = struct{}{}
+
+	if w.fsync == fsyncAlways {
+		if err := w.syncCur(); err != nil {
+			return job, err
+		}
+	} else if err := w.cur.w.Flush(); err != nil {
+		return job, fmt.Errorf("wal: flush segment %s: %w", w.cur.path, err)
+	}
+	return job, nil
+}
+
+// ack records that job seq has been mirrored and no longer needs to
+// be replayed.
+func (w *wal) ack(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.cur.size >= w.maxSegSize {
+		if err := w.rotate(); err != nil {
+			log.Printf("wal: rotate for ack %d: %v", seq, err)
+			return
+		}
+	}
+	n, err := writeWALRecord(w.cur.w, walRecord{typ: walRecordAck, ackSeq: seq})
+	if err != nil {
+		log.Printf("wal: ack %d: %v", seq, err)
+		return
+	}
+	w.cur.size += n
+	for _, seg := range w.segments {
+		if _, ok := seg.jobSeqs[seq]; ok {
+			seg.ackedSeq[seq] = struct{}{}
+			break
+		}
+	}
+	if w.fsync == fsyncAlways {
+		if err := w.syncCur(); err != nil {
+			log.Printf("wal: sync after ack %d: %v", seq, err)
+		}
+	} else if err := w.cur.w.Flush(); err != nil {
+		log.Printf("wal: flush after ack %d: %v", seq, err)
+	}
+}
+
+func (w *wal) syncCur() error {
+	if err := w.cur.w.Flush(); err != nil {
+		return fmt.Errorf("wal: flush segment %s: %w", w.cur.path, err)
+	}
+	if err := w.cur.f.Sync(); err != nil {
+		return fmt.Errorf("wal: fsync segment %s: %w", w.cur.path, err)
+	}
+	return nil
+}
+
+func (w *wal) fsyncLoop() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.fsyncTicker.C:
+			w.mu.Lock()
+			if err := w.syncCur(); err != nil {
+				log.Printf("wal: periodic fsync: %v", err)
+			}
+			w.mu.Unlock()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+// compactLoop periodically deletes segments whose every job has been
+// acked, keeping the current (still being written to) segment around
+// regardless of its ack state.
+func (w *wal) compactLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.compact()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *wal) compact() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	kept := w.segments[:0]
+	for _, seg := range w.segments {
+		if seg == w.cur || !seg.fullyAcked() {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := seg.f.Close(); err != nil {
+			log.Printf("wal: close acked segment %s: %v", seg.path, err)
+		}
+		if err := os.Remove(seg.path); err != nil {
+			log.Printf("wal: remove acked segment %s: %v", seg.path, err)
+		} else if debug {
+			log.Printf("wal: compacted segment %s", seg.path)
+		}
+	}
+	w.segments = kept
+}
+
+// close flushes and stops background goroutines. It does not remove
+// any segment: whatever is left on disk is replayed on next startup.
+func (w *wal) close() error {
+	close(w.stopCh)
+	if w.fsyncTicker != nil {
+		w.fsyncTicker.Stop()
+	}
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cur == nil {
+		return nil
+	}
+	return w.syncCur()
+}
+
+// ---------- record encoding ----------
+//
+// Record layout, all integers big-endian:
+//   type(1) | seq(8) | [job fields, only for walRecordJob]
+// Job fields:
+//   enqueuedAt unixNano(8) | bodySize(8) | methodLen(2) method |
+//   pathLen(2) path | headersLen(4) headers | bodyIsFile(1) |
+//   bodyLen(4) body-or-file-path
+//
+// When a job's body has been spilled to disk (see body.go), the WAL
+// stores the spill file's path instead of copying the body again;
+// bodyIsFile marks which case readWALRecord should reconstruct.
+
+type walRecord struct {
+	typ    byte
+	job    mirrorJob
+	ackSeq uint64
+}
+
+func writeWALRecord(w io.Writer, rec walRecord) (int64, error) {
+	buf := new(bytes32Writer)
+	buf.writeByte(rec.typ)
+	switch rec.typ {
+	case walRecordJob:
+		buf.writeUint64(rec.job.seq)
+		buf.writeUint64(uint64(rec.job.enqueuedAt.UnixNano()))
+		buf.writeUint64(uint64(rec.job.bodySize))
+		buf.writeBytes16([]byte(rec.job.method))
+		buf.writeBytes16([]byte(rec.job.path))
+		buf.writeBytes32([]byte(rec.job.headers))
+		if rec.job.bodyFile != "" {
+			buf.writeByte(1)
+			buf.writeBytes32([]byte(rec.job.bodyFile))
+		} else {
+			buf.writeByte(0)
+			buf.writeBytes32(rec.job.body)
+		}
+	case walRecordAck:
+		buf.writeUint64(rec.ackSeq)
+	default:
+		return 0, fmt.Errorf("wal: unknown record type %d", rec.typ)
+	}
+	n, err := w.Write(buf.b)
+	return int64(n), err
+}
+
+func readWALRecord(r *bufio.Reader) (walRecord, int64, error) {
+	var rec walRecord
+	typ, err := r.ReadByte()
+	if err != nil {
+		return rec, 0, err
+	}
+	rec.typ = typ
+	n := int64(1)
+
+	switch typ {
+	case walRecordJob:
+		seq, nn, err := readUint64(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		ts, nn, err := readUint64(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		bodySize, nn, err := readUint64(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		method, nn, err := readBytes16(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		path, nn, err := readBytes16(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		headers, nn, err := readBytes32(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		bodyIsFile, err := r.ReadByte()
+		n++
+		if err != nil {
+			return rec, n, err
+		}
+		bodyField, nn, err := readBytes32(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		rec.job = mirrorJob{
+			method:     string(method),
+			path:       string(path),
+			headers:    string(headers),
+			seq:        seq,
+			bodySize:   int64(bodySize),
+			enqueuedAt: time.Unix(0, int64(ts)),
+		}
+		if bodyIsFile == 1 {
+			rec.job.bodyFile = string(bodyField)
+		} else {
+			rec.job.body = bodyField
+		}
+	case walRecordAck:
+		seq, nn, err := readUint64(r)
+		n += nn
+		if err != nil {
+			return rec, n, err
+		}
+		rec.ackSeq = seq
+	default:
+		return rec, n, fmt.Errorf("wal: unknown record type %d", typ)
+	}
+	return rec, n, nil
+}
+
+func readUint64(r *bufio.Reader) (uint64, int64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), 8, nil
+}
+
+func readBytes16(r *bufio.Reader) ([]byte, int64, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(r, lb[:]); err != nil {
+		return nil, 0, err
+	}
+	l := binary.BigEndian.Uint16(lb[:])
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 2, err
+	}
+	return b, 2 + int64(l), nil
+}
+
+func readBytes32(r *bufio.Reader) ([]byte, int64, error) {
+	var lb [4]byte
+	if _, err := io.ReadFull(r, lb[:]); err != nil {
+		return nil, 0, err
+	}
+	l := binary.BigEndian.Uint32(lb[:])
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 4, err
+	}
+	return b, 4 + int64(l), nil
+}
+
+// bytes32Writer is a tiny helper around a growing []byte so record
+// encoding above reads as a flat list of field writes.
+type bytes32Writer struct {
+	b []byte
+}
+
+func (w *bytes32Writer) writeByte(v byte) {
+	w.b = append(w.b, v)
+}
+
+func (w *bytes32Writer) writeUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.b = append(w.b, b[:]...)
+}
+
+func (w *bytes32Writer) writeBytes16(v []byte) {
+	var lb [2]byte
+	binary.BigEndian.PutUint16(lb[:], uint16(len(v)))
+	w.b = append(w.b, lb[:]...)
+	w.b = append(w.b, v...)
+}
+
+func (w *bytes32Writer) writeBytes32(v []byte) {
+	var lb [4]byte
+	binary.BigEndian.PutUint32(lb[:], uint32(len(v)))
+	w.b = append(w.b, lb[:]...)
+	w.b = append(w.b, v...)
+}